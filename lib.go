@@ -1,40 +1,268 @@
 package gohaltlib
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/rpc"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"connectrpc.com/connect"
 	"github.com/1pkg/gohalt"
 	"github.com/astaxie/beego"
 	beegoctx "github.com/astaxie/beego/context"
+	"github.com/cloudwego/hertz/pkg/app"
+	kitexep "github.com/cloudwego/kitex/pkg/endpoint"
+	"github.com/cloudwego/kitex/pkg/kerrors"
+	"github.com/cloudwego/kitex/pkg/rpcinfo"
 	"github.com/gin-gonic/gin"
+	"github.com/go-chi/chi/v5"
 	"github.com/go-kit/kit/endpoint"
+	kitgrpc "github.com/go-kit/kit/transport/grpc"
+	kithttp "github.com/go-kit/kit/transport/http"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gorilla/mux"
 	iris "github.com/kataras/iris/v12"
 	echo "github.com/labstack/echo/v4"
 	"github.com/micro/go-micro/v2/client"
+	micrometa "github.com/micro/go-micro/v2/metadata"
 	"github.com/micro/go-micro/v2/server"
 	"github.com/revel/revel"
+	"github.com/twitchtv/twirp"
 	"github.com/valyala/fasthttp"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
+type IPResolver struct {
+	Trusted   []*net.IPNet
+	Hops      int
+	Forwarded bool
+}
+
+func NewIPResolver(cidrs []string, hops int, forwarded bool) (IPResolver, error) {
+	res := IPResolver{Hops: hops, Forwarded: forwarded}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return IPResolver{}, fmt.Errorf("invalid trusted ip %q", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return IPResolver{}, err
+		}
+		res.Trusted = append(res.Trusted, ipnet)
+	}
+	return res, nil
+}
+
+func (res IPResolver) Resolve(req *http.Request) string {
+	remote := normip(req.RemoteAddr)
+	if !res.trusted(remote) && !(res.Hops > 0 && len(res.Trusted) == 0) {
+		return remote
+	}
+	chain := res.chain(req)
+	if len(chain) == 0 {
+		return remote
+	}
+	if res.Hops > 0 {
+		i := len(chain) - res.Hops
+		if i < 0 {
+			i = 0
+		}
+		if net.ParseIP(chain[i]) == nil {
+			return remote
+		}
+		return chain[i]
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		switch {
+		case net.ParseIP(chain[i]) == nil && i == len(chain)-1:
+			return remote
+		case net.ParseIP(chain[i]) == nil:
+			return chain[i+1]
+		case !res.trusted(chain[i]):
+			return chain[i]
+		}
+	}
+	return chain[0]
+}
+
+func (res IPResolver) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range res.Trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (res IPResolver) chain(req *http.Request) []string {
+	var chain []string
+	if res.Forwarded {
+		for _, header := range req.Header.Values("Forwarded") {
+			for _, elem := range strings.Split(header, ",") {
+				for _, pair := range strings.Split(elem, ";") {
+					kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+					if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+						if addr := normip(strings.Trim(kv[1], `"`)); addr != "" {
+							chain = append(chain, addr)
+						}
+					}
+				}
+			}
+		}
+		if len(chain) > 0 {
+			return chain
+		}
+	}
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			if addr := normip(addr); addr != "" {
+				chain = append(chain, addr)
+			}
+		}
+	}
+	if addr := req.Header.Get("X-Real-Ip"); len(chain) == 0 && addr != "" {
+		chain = append(chain, normip(addr))
+	}
+	return chain
+}
+
+func normip(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+func weight(w int64) int64 {
+	if w < 1 {
+		return 1
+	}
+	return w
+}
+
+func cost(costs map[string]int64, key string) int64 {
+	if c, ok := costs[key]; ok {
+		return weight(c)
+	}
+	return 1
+}
+
+func priority(val string) (uint8, bool) {
+	p, err := strconv.ParseUint(strings.TrimSpace(val), 10, 8)
+	return uint8(p), err == nil
+}
+
+func route(method string, path string) string {
+	if path == "" {
+		return ""
+	}
+	return method + " " + path
+}
+
 func ip(req *http.Request) string {
-	first := func(ip string) string {
-		return strings.TrimSpace(strings.Split(ip, ",")[0])
+	return IPResolver{}.Resolve(req)
+}
+
+func nskey(ns string, key string) string {
+	if key == "" {
+		return ""
 	}
-	if ip := strings.TrimSpace(req.Header.Get("X-Real-Ip")); ip != "" {
-		return first(ip)
+	return ns + ":" + key
+}
+
+func joinkey(parts ...string) string {
+	return strings.Join(parts, "|")
+}
+
+type quota struct {
+	throttler string
+	limit     uint64
+	remaining uint64
+	reset     time.Duration
+}
+
+func newquota(err error) quota {
+	var q quota
+	var terr gohalt.ErrorThreshold
+	if !errors.As(err, &terr) || terr.Threshold == nil {
+		return q
+	}
+	q.throttler = terr.Throttler
+	pair := strings.SplitN(terr.Threshold.String(), " out of ", 2)
+	if len(pair) != 2 {
+		return q
+	}
+	if cur, err := strconv.ParseUint(pair[0], 10, 64); err == nil {
+		if lim, err := strconv.ParseUint(pair[1], 10, 64); err == nil {
+			q.limit = lim
+			if cur < lim {
+				q.remaining = lim - cur
+			}
+		}
+		return q
+	}
+	if cur, err := time.ParseDuration(pair[0]); err == nil {
+		if thr, err := time.ParseDuration(pair[1]); err == nil && cur < thr {
+			q.reset = thr - cur
+		}
 	}
-	if ip := strings.TrimSpace(req.Header.Get("X-Forwarded-For")); ip != "" {
-		return first(ip)
+	return q
+}
+
+func ratelimit(err error, set func(string, string)) {
+	q := newquota(err)
+	if q.limit > 0 {
+		limit, remaining := strconv.FormatUint(q.limit, 10), strconv.FormatUint(q.remaining, 10)
+		set("RateLimit-Limit", limit)
+		set("X-RateLimit-Limit", limit)
+		set("RateLimit-Remaining", remaining)
+		set("X-RateLimit-Remaining", remaining)
+	}
+	if q.reset > 0 {
+		reset := int64((q.reset + time.Second - 1) / time.Second)
+		set("RateLimit-Reset", strconv.FormatInt(reset, 10))
+		set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Unix()+reset, 10))
+		set("Retry-After", strconv.FormatInt(reset, 10))
 	}
-	return first(req.RemoteAddr)
 }
 
 type GinWith func(*gin.Context) context.Context
@@ -44,12 +272,65 @@ func GinWithIP(gctx *gin.Context) context.Context {
 	return gohalt.WithKey(req.Context(), ip(req))
 }
 
+func GinWithRoute(gctx *gin.Context) context.Context {
+	req := gctx.Request
+	return gohalt.WithKey(req.Context(), route(req.Method, gctx.FullPath()))
+}
+
+func GinWithRouteIP(gctx *gin.Context) context.Context {
+	req := gctx.Request
+	return gohalt.WithKey(req.Context(), joinkey(route(req.Method, gctx.FullPath()), ip(req)))
+}
+
+func GinWithSubnet(v4 int, v6 int) GinWith {
+	return GinWithStd(StdWithSubnet(v4, v6))
+}
+
+func GinWithIPResolver(res IPResolver) GinWith {
+	return GinWithStd(StdWithIPResolver(res))
+}
+
+func GinWithStd(with StdWith) GinWith {
+	return func(gctx *gin.Context) context.Context {
+		return with(gctx.Request)
+	}
+}
+
+func GinWithCost(costs map[string]int64) GinWith {
+	return func(gctx *gin.Context) context.Context {
+		req := gctx.Request
+		return gohalt.WithWeight(req.Context(), cost(costs, route(req.Method, gctx.FullPath())))
+	}
+}
+
+func GinWithPriorityHeader(header string) GinWith {
+	return GinWithStd(StdWithPriorityHeader(header))
+}
+
+func GinWithChain(withs ...GinWith) GinWith {
+	return func(gctx *gin.Context) context.Context {
+		req := gctx.Request
+		defer func() {
+			gctx.Request = req
+		}()
+		for _, with := range withs {
+			gctx.Request = gctx.Request.WithContext(with(gctx))
+		}
+		return gctx.Request.Context()
+	}
+}
+
 type GinOn func(*gin.Context, error)
 
 func GinOnAbort(gctx *gin.Context, err error) {
+	ratelimit(err, gctx.Header)
 	_ = gctx.AbortWithError(http.StatusTooManyRequests, err)
 }
 
+func GinOnTimeout(gctx *gin.Context, err error) {
+	_ = gctx.AbortWithError(http.StatusRequestTimeout, err)
+}
+
 func NewMiddlewareGin(thr gohalt.Throttler, with GinWith, on GinOn) gin.HandlerFunc {
 	return func(gctx *gin.Context) {
 		r := gohalt.NewRunnerSync(with(gctx), thr)
@@ -63,18 +344,218 @@ func NewMiddlewareGin(thr gohalt.Throttler, with GinWith, on GinOn) gin.HandlerF
 	}
 }
 
+func NewMiddlewareGinUpload(thr gohalt.Throttler, with GinWith, on GinOn, chunk int) gin.HandlerFunc {
+	return func(gctx *gin.Context) {
+		req := gctx.Request
+		if req.Body == nil || req.Body == http.NoBody {
+			gctx.Next()
+			return
+		}
+		b := newbody(req.Body, thr, with(gctx), chunk)
+		req.Body = b
+		gctx.Next()
+		if err := b.aborted(); err != nil && !gctx.Writer.Written() {
+			on(gctx, err)
+		}
+	}
+}
+
 type StdWith func(*http.Request) context.Context
 
 func StdWithIP(req *http.Request) context.Context {
 	return gohalt.WithKey(req.Context(), ip(req))
 }
 
+type StdKey func(*http.Request) string
+
+func StdKeyIP(req *http.Request) string {
+	return ip(req)
+}
+
+func StdWithKey(keys ...StdKey) StdWith {
+	return func(req *http.Request) context.Context {
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			parts = append(parts, key(req))
+		}
+		return gohalt.WithKey(req.Context(), joinkey(parts...))
+	}
+}
+
+func StdKeySubnet(key StdKey, v4 int, v6 int) StdKey {
+	mask := func(ip net.IP, ones int, bits int) string {
+		if ones < 0 {
+			ones = 0
+		}
+		if ones > bits {
+			ones = bits
+		}
+		m := net.CIDRMask(ones, bits)
+		return (&net.IPNet{IP: ip.Mask(m), Mask: m}).String()
+	}
+	return func(req *http.Request) string {
+		addr := key(req)
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return addr
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return mask(ip4, v4, net.IPv4len*8)
+		}
+		return mask(ip, v6, net.IPv6len*8)
+	}
+}
+
+func StdKeyJWT(claim string) StdKey {
+	return func(req *http.Request) string {
+		return nskey("jwt", jwtclaim(req, claim))
+	}
+}
+
+func StdKeyAPIKey(header string, query string) StdKey {
+	return func(req *http.Request) string {
+		if header != "" {
+			if key := strings.TrimSpace(req.Header.Get(header)); key != "" {
+				return nskey("apikey", key)
+			}
+		}
+		if query != "" && req.URL != nil {
+			return nskey("apikey", req.URL.Query().Get(query))
+		}
+		return ""
+	}
+}
+
+func StdKeyBasic(req *http.Request) string {
+	user, _, _ := req.BasicAuth()
+	return nskey("basic", user)
+}
+
+func jwtclaim(req *http.Request, claim string) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return ""
+	}
+	switch val := claims[claim].(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case json.Number:
+		return val.String()
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func StdKeyFirst(keys ...StdKey) StdKey {
+	return func(req *http.Request) string {
+		for _, key := range keys {
+			if k := key(req); k != "" {
+				return k
+			}
+		}
+		return ""
+	}
+}
+
+func StdWithJWT(claim string) StdWith {
+	return StdWithKey(StdKeyFirst(StdKeyJWT(claim), StdKeyIP))
+}
+
+func StdWithAPIKey(header string, query string) StdWith {
+	return StdWithKey(StdKeyFirst(StdKeyAPIKey(header, query), StdKeyIP))
+}
+
+func StdWithBasic(req *http.Request) context.Context {
+	return StdWithKey(StdKeyFirst(StdKeyBasic, StdKeyIP))(req)
+}
+
+func StdKeyServeMuxRoute(mux *http.ServeMux) StdKey {
+	return func(req *http.Request) string {
+		_, pattern := mux.Handler(req)
+		if strings.Contains(pattern, " ") {
+			return pattern
+		}
+		return route(req.Method, pattern)
+	}
+}
+
+func StdWithServeMuxRoute(mux *http.ServeMux) StdWith {
+	return StdWithKey(StdKeyServeMuxRoute(mux))
+}
+
+func StdWithServeMuxRouteIP(mux *http.ServeMux) StdWith {
+	return StdWithKey(StdKeyServeMuxRoute(mux), StdKeyIP)
+}
+
+func StdWithSubnet(v4 int, v6 int) StdWith {
+	return StdWithKey(StdKeySubnet(StdKeyIP, v4, v6))
+}
+
+func StdWithContentLength(req *http.Request) context.Context {
+	return gohalt.WithWeight(req.Context(), weight(req.ContentLength))
+}
+
+func StdWithCost(key StdKey, costs map[string]int64) StdWith {
+	return func(req *http.Request) context.Context {
+		return gohalt.WithWeight(req.Context(), cost(costs, key(req)))
+	}
+}
+
+func StdWithPriority(prio func(*http.Request) uint8) StdWith {
+	return func(req *http.Request) context.Context {
+		return gohalt.WithPriority(req.Context(), prio(req))
+	}
+}
+
+func StdWithPriorityHeader(header string) StdWith {
+	return func(req *http.Request) context.Context {
+		if p, ok := priority(req.Header.Get(header)); ok {
+			return gohalt.WithPriority(req.Context(), p)
+		}
+		return req.Context()
+	}
+}
+
+func StdWithChain(withs ...StdWith) StdWith {
+	return func(req *http.Request) context.Context {
+		for _, with := range withs {
+			req = req.WithContext(with(req))
+		}
+		return req.Context()
+	}
+}
+
+func StdWithIPResolver(res IPResolver) StdWith {
+	return StdWithKey(res.Resolve)
+}
+
 type StdOn func(http.ResponseWriter, error)
 
 func StdOnAbort(w http.ResponseWriter, err error) {
+	ratelimit(err, w.Header().Set)
 	http.Error(w, err.Error(), http.StatusTooManyRequests)
 }
 
+func StdOnTimeout(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), http.StatusRequestTimeout)
+}
+
 func NewMiddlewareStd(h http.Handler, thr gohalt.Throttler, with StdWith, on StdOn) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		r := gohalt.NewRunnerSync(with(req), thr)
@@ -88,6 +569,98 @@ func NewMiddlewareStd(h http.Handler, thr gohalt.Throttler, with StdWith, on Std
 	})
 }
 
+type body struct {
+	io.ReadCloser
+	lock sync.Mutex
+	err  error
+}
+
+func newbody(rc io.ReadCloser, thr gohalt.Throttler, ctx context.Context, chunk int) *body {
+	b := &body{}
+	b.ReadCloser = NewReadCloserBandwidth(rc, thr, func(IOKind, []byte) context.Context {
+		return ctx
+	}, func(err error) error {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.err == nil {
+			b.err = err
+		}
+		return err
+	}, chunk)
+	return b
+}
+
+func (b *body) aborted() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.err
+}
+
+func NewMiddlewareStdUpload(h http.Handler, thr gohalt.Throttler, with StdWith, on StdOn, chunk int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Body == nil || req.Body == http.NoBody {
+			h.ServeHTTP(w, req)
+			return
+		}
+		b := newbody(req.Body, thr, with(req), chunk)
+		req.Body = b
+		rw := &respwriter{ResponseWriter: w, w: w}
+		h.ServeHTTP(rw, req)
+		if err := b.aborted(); err != nil && !rw.written {
+			on(w, err)
+		}
+	})
+}
+
+type respwriter struct {
+	http.ResponseWriter
+	w       io.Writer
+	written bool
+}
+
+func (w *respwriter) WriteHeader(code int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *respwriter) Write(p []byte) (int, error) {
+	w.written = true
+	return w.w.Write(p)
+}
+
+func (w *respwriter) ReadFrom(r io.Reader) (int64, error) {
+	w.written = true
+	return io.Copy(w.w, r)
+}
+
+func (w *respwriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *respwriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		w.written = true
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("response writer doesn't support hijacking")
+}
+
+func (w *respwriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func NewMiddlewareStdDownload(h http.Handler, thr gohalt.Throttler, with StdWith, on RWOn, chunk int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := with(req)
+		bw := NewWriterBandwidth(w, thr, func(IOKind, []byte) context.Context {
+			return ctx
+		}, on, chunk)
+		h.ServeHTTP(&respwriter{ResponseWriter: w, w: bw}, req)
+	})
+}
+
 type EchoWith func(echo.Context) context.Context
 
 func EchoWithIP(ectx echo.Context) context.Context {
@@ -95,12 +668,63 @@ func EchoWithIP(ectx echo.Context) context.Context {
 	return gohalt.WithKey(req.Context(), ip(req))
 }
 
+func EchoWithRoute(ectx echo.Context) context.Context {
+	req := ectx.Request()
+	return gohalt.WithKey(req.Context(), route(req.Method, ectx.Path()))
+}
+
+func EchoWithRouteIP(ectx echo.Context) context.Context {
+	req := ectx.Request()
+	return gohalt.WithKey(req.Context(), joinkey(route(req.Method, ectx.Path()), ip(req)))
+}
+
+func EchoWithSubnet(v4 int, v6 int) EchoWith {
+	return EchoWithStd(StdWithSubnet(v4, v6))
+}
+
+func EchoWithIPResolver(res IPResolver) EchoWith {
+	return EchoWithStd(StdWithIPResolver(res))
+}
+
+func EchoWithStd(with StdWith) EchoWith {
+	return func(ectx echo.Context) context.Context {
+		return with(ectx.Request())
+	}
+}
+
+func EchoWithCost(costs map[string]int64) EchoWith {
+	return func(ectx echo.Context) context.Context {
+		req := ectx.Request()
+		return gohalt.WithWeight(req.Context(), cost(costs, route(req.Method, ectx.Path())))
+	}
+}
+
+func EchoWithPriorityHeader(header string) EchoWith {
+	return EchoWithStd(StdWithPriorityHeader(header))
+}
+
+func EchoWithChain(withs ...EchoWith) EchoWith {
+	return func(ectx echo.Context) context.Context {
+		req := ectx.Request()
+		defer ectx.SetRequest(req)
+		for _, with := range withs {
+			ectx.SetRequest(ectx.Request().WithContext(with(ectx)))
+		}
+		return ectx.Request().Context()
+	}
+}
+
 type EchoOn func(echo.Context, error) error
 
 func EchoOnAbort(ectx echo.Context, err error) error {
+	ratelimit(err, ectx.Response().Header().Set)
 	return ectx.String(http.StatusTooManyRequests, err.Error())
 }
 
+func EchoOnTimeout(ectx echo.Context, err error) error {
+	return ectx.String(http.StatusRequestTimeout, err.Error())
+}
+
 func NewMiddlewareEcho(thr gohalt.Throttler, with EchoWith, on EchoOn) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(ectx echo.Context) (err error) {
@@ -117,6 +741,24 @@ func NewMiddlewareEcho(thr gohalt.Throttler, with EchoWith, on EchoOn) echo.Midd
 	}
 }
 
+func NewMiddlewareEchoUpload(thr gohalt.Throttler, with EchoWith, on EchoOn, chunk int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ectx echo.Context) error {
+			req := ectx.Request()
+			if req.Body == nil || req.Body == http.NoBody {
+				return next(ectx)
+			}
+			b := newbody(req.Body, thr, with(ectx), chunk)
+			req.Body = b
+			err := next(ectx)
+			if aerr := b.aborted(); aerr != nil && !ectx.Response().Committed {
+				return on(ectx, aerr)
+			}
+			return err
+		}
+	}
+}
+
 type BeegoWith func(*beegoctx.Context) context.Context
 
 func BeegoWithIP(bctx *beegoctx.Context) context.Context {
@@ -124,9 +766,24 @@ func BeegoWithIP(bctx *beegoctx.Context) context.Context {
 	return gohalt.WithKey(req.Context(), ip(req))
 }
 
+func BeegoWithSubnet(v4 int, v6 int) BeegoWith {
+	return BeegoWithStd(StdWithSubnet(v4, v6))
+}
+
+func BeegoWithIPResolver(res IPResolver) BeegoWith {
+	return BeegoWithStd(StdWithIPResolver(res))
+}
+
+func BeegoWithStd(with StdWith) BeegoWith {
+	return func(bctx *beegoctx.Context) context.Context {
+		return with(bctx.Request)
+	}
+}
+
 type BeegoOn func(*beegoctx.Context, error)
 
 func BeegoOnAbort(bctx *beegoctx.Context, err error) {
+	ratelimit(err, bctx.Output.Header)
 	bctx.Abort(http.StatusTooManyRequests, err.Error())
 }
 
@@ -142,22 +799,99 @@ func NewMiddlewareBeego(thr gohalt.Throttler, with BeegoWith, on BeegoOn) beego.
 	}
 }
 
-type KitWith func(context.Context, interface{}) context.Context
+type KitKey func(context.Context, interface{}) string
 
-func KitWithEmpty(ctx context.Context, req interface{}) context.Context {
-	return ctx
+func KitKeyPath(ctx context.Context, req interface{}) string {
+	path, _ := ctx.Value(kithttp.ContextKeyRequestPath).(string)
+	return path
 }
 
-type KitOn func(error) (interface{}, error)
+func KitKeyIP(ctx context.Context, req interface{}) string {
+	if addr, ok := ctx.Value(kithttp.ContextKeyRequestRemoteAddr).(string); ok && addr != "" {
+		return normip(addr)
+	}
+	return normip(GRPCKeyPeer(ctx, req))
+}
 
-func KitOnAbort(err error) (interface{}, error) {
-	return nil, fmt.Errorf("%d: %w", http.StatusTooManyRequests, err)
+func KitKeyGRPCMethod(ctx context.Context, req interface{}) string {
+	if method, ok := ctx.Value(kitgrpc.ContextKeyRequestMethod).(string); ok {
+		return method
+	}
+	return GRPCKeyMethod(ctx, req)
 }
 
-func NewMiddlewareKit(thr gohalt.Throttler, with KitWith, on KitOn) endpoint.Middleware {
-	return func(next endpoint.Endpoint) endpoint.Endpoint {
-		return func(ctx context.Context, req interface{}) (resp interface{}, err error) {
-			r := gohalt.NewRunnerSync(with(ctx, req), thr)
+func KitKeyMetadata(key string) KitKey {
+	return KitKey(GRPCKeyMetadata(key))
+}
+
+type KitWith func(context.Context, interface{}) context.Context
+
+func KitWithEmpty(ctx context.Context, req interface{}) context.Context {
+	return ctx
+}
+
+func KitWithKey(keys ...KitKey) KitWith {
+	return func(ctx context.Context, req interface{}) context.Context {
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			parts = append(parts, key(ctx, req))
+		}
+		return gohalt.WithKey(ctx, joinkey(parts...))
+	}
+}
+
+func KitWithPath(ctx context.Context, req interface{}) context.Context {
+	return KitWithKey(KitKeyPath)(ctx, req)
+}
+
+func KitWithIP(ctx context.Context, req interface{}) context.Context {
+	return KitWithKey(KitKeyIP)(ctx, req)
+}
+
+func KitWithGRPCMethod(ctx context.Context, req interface{}) context.Context {
+	return KitWithKey(KitKeyGRPCMethod)(ctx, req)
+}
+
+func KitWithMetadata(key string) KitWith {
+	return KitWithKey(KitKeyMetadata(key))
+}
+
+type KitOn func(error) (interface{}, error)
+
+func KitOnAbort(err error) (interface{}, error) {
+	return nil, kiterr{err: err}
+}
+
+type kiterr struct {
+	err error
+}
+
+func (err kiterr) Error() string {
+	return fmt.Sprintf("%d: %v", http.StatusTooManyRequests, err.err)
+}
+
+func (err kiterr) Unwrap() error {
+	return err.err
+}
+
+func (err kiterr) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+func (err kiterr) Headers() http.Header {
+	header := make(http.Header)
+	ratelimit(err.err, header.Set)
+	return header
+}
+
+func (err kiterr) GRPCStatus() *status.Status {
+	return status.Convert(GRPCOnResourceExhausted(err.err))
+}
+
+func NewMiddlewareKit(thr gohalt.Throttler, with KitWith, on KitOn) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, req interface{}) (resp interface{}, err error) {
+			r := gohalt.NewRunnerSync(with(ctx, req), thr)
 			r.Run(func(ctx context.Context) error {
 				resp, err = next(ctx, req)
 				return nil
@@ -176,6 +910,31 @@ func MuxWithIP(req *http.Request) context.Context {
 	return StdWithIP(req)
 }
 
+func MuxKeyRoute(req *http.Request) string {
+	if r := mux.CurrentRoute(req); r != nil {
+		if tmpl, err := r.GetPathTemplate(); err == nil {
+			return route(req.Method, tmpl)
+		}
+	}
+	return ""
+}
+
+func MuxWithRoute(req *http.Request) context.Context {
+	return StdWithKey(MuxKeyRoute)(req)
+}
+
+func MuxWithRouteIP(req *http.Request) context.Context {
+	return StdWithKey(MuxKeyRoute, StdKeyIP)(req)
+}
+
+func MuxWithSubnet(v4 int, v6 int) MuxWith {
+	return MuxWith(StdWithSubnet(v4, v6))
+}
+
+func MuxWithIPResolver(res IPResolver) MuxWith {
+	return MuxWith(StdWithIPResolver(res))
+}
+
 type MuxOn StdOn
 
 func MuxOnAbort(w http.ResponseWriter, err error) {
@@ -192,6 +951,28 @@ func RouterWithIP(req *http.Request) context.Context {
 	return StdWithIP(req)
 }
 
+func RouterKeyRoute(method string, pattern string) StdKey {
+	return func(req *http.Request) string {
+		return route(method, pattern)
+	}
+}
+
+func RouterWithRoute(method string, pattern string) RouterWith {
+	return RouterWith(StdWithKey(RouterKeyRoute(method, pattern)))
+}
+
+func RouterWithRouteIP(method string, pattern string) RouterWith {
+	return RouterWith(StdWithKey(RouterKeyRoute(method, pattern), StdKeyIP))
+}
+
+func RouterWithSubnet(v4 int, v6 int) RouterWith {
+	return RouterWith(StdWithSubnet(v4, v6))
+}
+
+func RouterWithIPResolver(res IPResolver) RouterWith {
+	return RouterWith(StdWithIPResolver(res))
+}
+
 type RouterOn StdOn
 
 func RouterOnAbort(w http.ResponseWriter, err error) {
@@ -202,24 +983,94 @@ func NewMiddlewareRouter(h http.Handler, thr gohalt.Throttler, with RouterWith,
 	return NewMiddlewareStd(h, thr, StdWith(with), StdOn(on))
 }
 
+type ChiWith StdWith
+
+func ChiWithIP(req *http.Request) context.Context {
+	return StdWithIP(req)
+}
+
+func ChiWithIPResolver(res IPResolver) ChiWith {
+	return ChiWith(StdWithIPResolver(res))
+}
+
+func ChiKeyRoutePattern(req *http.Request) string {
+	rctx := chi.RouteContext(req.Context())
+	if rctx == nil {
+		return ""
+	}
+	pattern := rctx.RoutePattern()
+	if rctx.Routes != nil {
+		path := req.URL.RawPath
+		if path == "" {
+			path = req.URL.Path
+		}
+		tctx := chi.NewRouteContext()
+		if rctx.Routes.Match(tctx, req.Method, path) {
+			pattern = tctx.RoutePattern()
+		}
+	}
+	return route(req.Method, pattern)
+}
+
+func ChiWithRoutePattern(req *http.Request) context.Context {
+	return StdWithKey(ChiKeyRoutePattern)(req)
+}
+
+func ChiWithRoutePatternIP(req *http.Request) context.Context {
+	return StdWithKey(ChiKeyRoutePattern, StdKeyIP)(req)
+}
+
+type ChiOn StdOn
+
+func ChiOnAbort(w http.ResponseWriter, err error) {
+	StdOnAbort(w, err)
+}
+
+func NewMiddlewareChi(thr gohalt.Throttler, with ChiWith, on ChiOn) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return NewMiddlewareStd(h, thr, StdWith(with), StdOn(on))
+	}
+}
+
 type RevealWith func(*revel.Controller) context.Context
 
-func RevealWithIP(rc *revel.Controller) context.Context {
+func revelreq(rc *revel.Controller) *http.Request {
 	req := rc.Request
-	keys := req.Header.Server.GetKeys()
 	stdreq := &http.Request{
+		Method:     req.Method,
+		URL:        req.URL,
+		Host:       req.Host,
 		Header:     make(http.Header),
 		RemoteAddr: rc.ClientIP,
 	}
-	for _, key := range keys {
+	for _, key := range req.Header.Server.GetKeys() {
 		stdreq.Header.Add(key, req.Header.Get(key))
 	}
-	return gohalt.WithKey(req.Context(), ip(stdreq))
+	return stdreq.WithContext(req.Context())
+}
+
+func RevealWithIP(rc *revel.Controller) context.Context {
+	return gohalt.WithKey(rc.Request.Context(), ip(revelreq(rc)))
+}
+
+func RevealWithSubnet(v4 int, v6 int) RevealWith {
+	return RevealWithStd(StdWithSubnet(v4, v6))
+}
+
+func RevealWithIPResolver(res IPResolver) RevealWith {
+	return RevealWithStd(StdWithIPResolver(res))
+}
+
+func RevealWithStd(with StdWith) RevealWith {
+	return func(rc *revel.Controller) context.Context {
+		return with(revelreq(rc))
+	}
 }
 
 type RevealOn func(error) revel.Result
 
 func RevealOnAbort(rc *revel.Controller, err error) revel.Result {
+	ratelimit(err, rc.Response.Out.Header().Set)
 	result := rc.RenderError(err)
 	rc.Response.Status = http.StatusTooManyRequests
 	return result
@@ -245,9 +1096,41 @@ func IrisWithIP(ictx iris.Context) context.Context {
 	return gohalt.WithKey(req.Context(), ip(req))
 }
 
+func IrisWithRoute(ictx iris.Context) context.Context {
+	req := ictx.Request()
+	return gohalt.WithKey(req.Context(), irisroute(ictx))
+}
+
+func IrisWithRouteIP(ictx iris.Context) context.Context {
+	req := ictx.Request()
+	return gohalt.WithKey(req.Context(), joinkey(irisroute(ictx), ip(req)))
+}
+
+func irisroute(ictx iris.Context) string {
+	if r := ictx.GetCurrentRoute(); r != nil {
+		return route(r.Method(), r.Path())
+	}
+	return ""
+}
+
+func IrisWithSubnet(v4 int, v6 int) IrisWith {
+	return IrisWithStd(StdWithSubnet(v4, v6))
+}
+
+func IrisWithIPResolver(res IPResolver) IrisWith {
+	return IrisWithStd(StdWithIPResolver(res))
+}
+
+func IrisWithStd(with StdWith) IrisWith {
+	return func(ictx iris.Context) context.Context {
+		return with(ictx.Request())
+	}
+}
+
 type IrisOn func(iris.Context, error)
 
 func IrisOnAbort(ictx iris.Context, err error) {
+	ratelimit(err, ictx.Header)
 	ictx.StatusCode(http.StatusTooManyRequests)
 	_, _ = ictx.WriteString(err.Error())
 }
@@ -267,21 +1150,57 @@ func NewMiddlewareIris(thr gohalt.Throttler, with IrisWith, on IrisOn) iris.Hand
 
 type FastWith func(*fasthttp.RequestCtx) context.Context
 
-func FastWithIPBackground(fctx *fasthttp.RequestCtx) context.Context {
+func fastreq(fctx *fasthttp.RequestCtx) *http.Request {
 	stdreq := &http.Request{
-		Header:     make(http.Header),
-		RemoteAddr: fctx.RemoteIP().String(),
+		Method:        string(fctx.Method()),
+		URL:           &url.URL{Path: string(fctx.Path()), RawQuery: string(fctx.QueryArgs().QueryString())},
+		Host:          string(fctx.Host()),
+		Header:        make(http.Header),
+		ContentLength: int64(fctx.Request.Header.ContentLength()),
+		RemoteAddr:    fctx.RemoteIP().String(),
 	}
 	fctx.Request.Header.VisitAll(func(key []byte, val []byte) {
 		stdreq.Header.Add(string(key), string(val))
 	})
-	return gohalt.WithKey(context.Background(), ip(stdreq))
+	return stdreq
+}
+
+func FastWithIPBackground(fctx *fasthttp.RequestCtx) context.Context {
+	return gohalt.WithKey(context.Background(), ip(fastreq(fctx)))
+}
+
+func FastWithSubnetBackground(v4 int, v6 int) FastWith {
+	return FastWithStdBackground(StdWithSubnet(v4, v6))
+}
+
+func FastWithIPResolverBackground(res IPResolver) FastWith {
+	return FastWithStdBackground(StdWithIPResolver(res))
+}
+
+func FastWithPriorityHeaderBackground(header string) FastWith {
+	return func(fctx *fasthttp.RequestCtx) context.Context {
+		if p, ok := priority(string(fctx.Request.Header.Peek(header))); ok {
+			return gohalt.WithPriority(context.Background(), p)
+		}
+		return context.Background()
+	}
+}
+
+func FastWithStdBackground(with StdWith) FastWith {
+	return func(fctx *fasthttp.RequestCtx) context.Context {
+		return with(fastreq(fctx))
+	}
 }
 
 type FastOn func(*fasthttp.RequestCtx, error)
 
 func FastOnAbort(fctx *fasthttp.RequestCtx, err error) {
 	fctx.Error(err.Error(), fasthttp.StatusTooManyRequests)
+	ratelimit(err, fctx.Response.Header.Set)
+}
+
+func FastOnTimeout(fctx *fasthttp.RequestCtx, err error) {
+	fctx.Error(err.Error(), fasthttp.StatusRequestTimeout)
 }
 
 func NewMiddlewareFast(h fasthttp.RequestHandler, thr gohalt.Throttler, with FastWith, on FastOn) fasthttp.RequestHandler {
@@ -297,6 +1216,188 @@ func NewMiddlewareFast(h fasthttp.RequestHandler, thr gohalt.Throttler, with Fas
 	}
 }
 
+type fastctxbody struct{}
+
+func FastRequestBodyStream(fctx *fasthttp.RequestCtx) io.Reader {
+	if b, ok := fctx.UserValue(fastctxbody{}).(*body); ok {
+		return b
+	}
+	return fctx.RequestBodyStream()
+}
+
+func NewMiddlewareFastUpload(
+	h fasthttp.RequestHandler,
+	thr gohalt.Throttler,
+	with FastWith,
+	on FastOn,
+	chunk int,
+) fasthttp.RequestHandler {
+	return func(fctx *fasthttp.RequestCtx) {
+		stream := fctx.RequestBodyStream()
+		if stream == nil {
+			if len(fctx.PostBody()) == 0 {
+				h(fctx)
+				return
+			}
+			fctx.Logger().Printf("fasthttp upload throttling buffered request body, enable server stream request body")
+			b := newbody(io.NopCloser(bytes.NewReader(fctx.PostBody())), thr, with(fctx), chunk)
+			if _, err := io.Copy(io.Discard, b); err != nil {
+				on(fctx, err)
+				return
+			}
+			h(fctx)
+			return
+		}
+		b := newbody(io.NopCloser(stream), thr, with(fctx), chunk)
+		fctx.SetUserValue(fastctxbody{}, b)
+		h(fctx)
+		if err := b.aborted(); err != nil && !fastwritten(fctx) {
+			on(fctx, err)
+		}
+	}
+}
+
+func fastwritten(fctx *fasthttp.RequestCtx) bool {
+	resp := &fctx.Response
+	return resp.StatusCode() != fasthttp.StatusOK || resp.IsBodyStream() || len(resp.Body()) > 0
+}
+
+type FiberWith func(*fiber.Ctx) context.Context
+
+func FiberWithIP(fctx *fiber.Ctx) context.Context {
+	return gohalt.WithKey(fctx.UserContext(), normip(fctx.IP()))
+}
+
+type FiberOn func(*fiber.Ctx, error) error
+
+func FiberOnAbort(fctx *fiber.Ctx, err error) error {
+	ratelimit(err, fctx.Set)
+	return fctx.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+}
+
+func NewMiddlewareFiber(thr gohalt.Throttler, with FiberWith, on FiberOn) fiber.Handler {
+	return func(fctx *fiber.Ctx) (err error) {
+		r := gohalt.NewRunnerSync(with(fctx), thr)
+		r.Run(func(ctx context.Context) error {
+			err = fctx.Next()
+			return nil
+		})
+		if err := r.Result(); err != nil {
+			return on(fctx, err)
+		}
+		return err
+	}
+}
+
+type HertzWith func(context.Context, *app.RequestContext) context.Context
+
+func HertzWithIP(ctx context.Context, hctx *app.RequestContext) context.Context {
+	return gohalt.WithKey(ctx, hertzip(hctx))
+}
+
+func HertzWithRoute(ctx context.Context, hctx *app.RequestContext) context.Context {
+	return gohalt.WithKey(ctx, route(string(hctx.Method()), hctx.FullPath()))
+}
+
+func HertzWithRouteIP(ctx context.Context, hctx *app.RequestContext) context.Context {
+	return gohalt.WithKey(ctx, joinkey(route(string(hctx.Method()), hctx.FullPath()), hertzip(hctx)))
+}
+
+func hertzip(hctx *app.RequestContext) string {
+	if addr := hctx.RemoteAddr(); addr != nil {
+		return normip(addr.String())
+	}
+	return ""
+}
+
+type HertzOn func(context.Context, *app.RequestContext, error)
+
+func HertzOnAbort(ctx context.Context, hctx *app.RequestContext, err error) {
+	ratelimit(err, hctx.Header)
+	hctx.AbortWithMsg(err.Error(), http.StatusTooManyRequests)
+}
+
+func NewMiddlewareHertz(thr gohalt.Throttler, with HertzWith, on HertzOn) app.HandlerFunc {
+	return func(ctx context.Context, hctx *app.RequestContext) {
+		r := gohalt.NewRunnerSync(with(ctx, hctx), thr)
+		r.Run(func(ctx context.Context) error {
+			hctx.Next(ctx)
+			return nil
+		})
+		if err := r.Result(); err != nil {
+			on(ctx, hctx, err)
+		}
+	}
+}
+
+type KitexKey func(context.Context, interface{}) string
+
+func KitexKeyMethod(ctx context.Context, req interface{}) string {
+	ri := rpcinfo.GetRPCInfo(ctx)
+	if ri == nil || ri.To() == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", ri.To().ServiceName(), ri.To().Method())
+}
+
+func KitexKeyIP(ctx context.Context, req interface{}) string {
+	ri := rpcinfo.GetRPCInfo(ctx)
+	if ri == nil || ri.From() == nil || ri.From().Address() == nil {
+		return ""
+	}
+	return normip(ri.From().Address().String())
+}
+
+type KitexWith func(context.Context, interface{}) context.Context
+
+func KitexWithEmpty(ctx context.Context, req interface{}) context.Context {
+	return ctx
+}
+
+func KitexWithKey(keys ...KitexKey) KitexWith {
+	return func(ctx context.Context, req interface{}) context.Context {
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			parts = append(parts, key(ctx, req))
+		}
+		return gohalt.WithKey(ctx, joinkey(parts...))
+	}
+}
+
+func KitexWithMethod(ctx context.Context, req interface{}) context.Context {
+	return KitexWithKey(KitexKeyMethod)(ctx, req)
+}
+
+func KitexWithIP(ctx context.Context, req interface{}) context.Context {
+	return KitexWithKey(KitexKeyIP)(ctx, req)
+}
+
+type KitexOn func(error) error
+
+func KitexOnAbort(err error) error {
+	extra := make(map[string]string)
+	ratelimit(err, func(key string, val string) {
+		extra[key] = val
+	})
+	return kerrors.NewBizStatusErrorWithExtra(http.StatusTooManyRequests, err.Error(), extra)
+}
+
+func NewMiddlewareKitex(thr gohalt.Throttler, with KitexWith, on KitexOn) kitexep.Middleware {
+	return func(next kitexep.Endpoint) kitexep.Endpoint {
+		return func(ctx context.Context, req interface{}, resp interface{}) (err error) {
+			r := gohalt.NewRunnerSync(with(ctx, req), thr)
+			r.Run(func(ctx context.Context) error {
+				err = next(ctx, req, resp)
+				return nil
+			})
+			if err := r.Result(); err != nil {
+				return on(err)
+			}
+			return err
+		}
+	}
+}
+
 type RoundTripperStdWith func(*http.Request) context.Context
 
 func RoundTripperStdWithEmpty(req *http.Request) context.Context {
@@ -495,96 +1596,732 @@ func (cs grpccs) SendMsg(msg interface{}) (err error) {
 	if err := r.Result(); err != nil {
 		return cs.on(err)
 	}
-	return err
+	return err
+}
+
+func (cs grpccs) RecvMsg(msg interface{}) (err error) {
+	r := gohalt.NewRunnerSync(cs.with(cs.Context(), msg), cs.thr)
+	r.Run(func(ctx context.Context) error {
+		err = cs.ClientStream.RecvMsg(msg)
+		return nil
+	})
+	if err := r.Result(); err != nil {
+		return cs.on(err)
+	}
+	return err
+}
+
+type grpcss struct {
+	grpc.ServerStream
+	thr  gohalt.Throttler
+	with GRPCStreamWith
+	on   GRPCStreamOn
+}
+
+func NewGrpServerStream(ss grpc.ServerStream, thr gohalt.Throttler, with GRPCStreamWith, on GRPCStreamOn) grpc.ServerStream {
+	return grpcss{ServerStream: ss, thr: thr, with: with, on: on}
+}
+
+func (ss grpcss) SendMsg(msg interface{}) (err error) {
+	r := gohalt.NewRunnerSync(ss.with(ss.Context(), msg), ss.thr)
+	r.Run(func(ctx context.Context) error {
+		err = ss.ServerStream.SendMsg(msg)
+		return nil
+	})
+	if err := r.Result(); err != nil {
+		return ss.on(err)
+	}
+	return err
+}
+
+func (ss grpcss) RecvMsg(msg interface{}) (err error) {
+	r := gohalt.NewRunnerSync(ss.with(ss.Context(), msg), ss.thr)
+	r.Run(func(ctx context.Context) error {
+		err = ss.ServerStream.RecvMsg(msg)
+		return nil
+	})
+	if err := r.Result(); err != nil {
+		return ss.on(err)
+	}
+	return err
+}
+
+type GRPCWith = GRPCStreamWith
+
+func GRPCWithEmpty(ctx context.Context, req interface{}) context.Context {
+	return ctx
+}
+
+type GRPCOn = GRPCStreamOn
+
+func GRPCOnAbort(err error) error {
+	return err
+}
+
+type grpcctxmethod struct{}
+
+type GRPCKey func(context.Context, interface{}) string
+
+func GRPCKeyMethod(ctx context.Context, req interface{}) string {
+	if method, ok := grpc.Method(ctx); ok {
+		return method
+	}
+	if method, ok := ctx.Value(grpcctxmethod{}).(string); ok {
+		return method
+	}
+	return ""
+}
+
+func GRPCKeyPeer(ctx context.Context, req interface{}) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func GRPCKeyForwardedFor(ctx context.Context, req interface{}) string {
+	return strings.TrimSpace(strings.Split(GRPCKeyMetadata("x-forwarded-for")(ctx, req), ",")[0])
+}
+
+func GRPCKeyMetadata(key string) GRPCKey {
+	return func(ctx context.Context, req interface{}) string {
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok {
+			md, _ = metadata.FromOutgoingContext(ctx)
+		}
+		if vals := md.Get(key); len(vals) > 0 {
+			return strings.TrimSpace(vals[0])
+		}
+		return ""
+	}
+}
+
+func GRPCWithKey(keys ...GRPCKey) GRPCWith {
+	return func(ctx context.Context, req interface{}) context.Context {
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			parts = append(parts, key(ctx, req))
+		}
+		return gohalt.WithKey(ctx, joinkey(parts...))
+	}
+}
+
+func GRPCWithMethod(ctx context.Context, req interface{}) context.Context {
+	return GRPCWithKey(GRPCKeyMethod)(ctx, req)
+}
+
+func GRPCWithPeer(ctx context.Context, req interface{}) context.Context {
+	return GRPCWithKey(GRPCKeyPeer)(ctx, req)
+}
+
+func GRPCWithForwardedFor(ctx context.Context, req interface{}) context.Context {
+	return GRPCWithKey(GRPCKeyForwardedFor)(ctx, req)
+}
+
+func GRPCWithSize(ctx context.Context, req interface{}) context.Context {
+	if msg, ok := req.(protoadapt.MessageV1); ok {
+		return gohalt.WithWeight(ctx, weight(int64(proto.Size(protoadapt.MessageV2Of(msg)))))
+	}
+	return gohalt.WithWeight(ctx, 1)
+}
+
+func GRPCWithCost(costs map[string]int64) GRPCWith {
+	return func(ctx context.Context, req interface{}) context.Context {
+		return gohalt.WithWeight(ctx, cost(costs, GRPCKeyMethod(ctx, req)))
+	}
+}
+
+func GRPCWithPriority(prio func(context.Context, interface{}) uint8) GRPCWith {
+	return func(ctx context.Context, req interface{}) context.Context {
+		return gohalt.WithPriority(ctx, prio(ctx, req))
+	}
+}
+
+func GRPCWithPriorityMetadata(key string) GRPCWith {
+	return func(ctx context.Context, req interface{}) context.Context {
+		if p, ok := priority(GRPCKeyMetadata(key)(ctx, req)); ok {
+			return gohalt.WithPriority(ctx, p)
+		}
+		return ctx
+	}
+}
+
+func GRPCWithChain(withs ...GRPCWith) GRPCWith {
+	return func(ctx context.Context, req interface{}) context.Context {
+		for _, with := range withs {
+			ctx = with(ctx, req)
+		}
+		return ctx
+	}
+}
+
+func GRPCOnResourceExhausted(err error) error {
+	q := newquota(err)
+	st := status.New(codes.ResourceExhausted, err.Error())
+	details := []protoadapt.MessageV1{
+		&errdetails.QuotaFailure{
+			Violations: []*errdetails.QuotaFailure_Violation{
+				{Subject: q.throttler, Description: err.Error()},
+			},
+		},
+	}
+	if q.reset > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(q.reset)})
+	}
+	dst, derr := st.WithDetails(details...)
+	if derr != nil {
+		return st.Err()
+	}
+	return dst.Err()
+}
+
+func NewGRPCUnaryServerInterceptor(thr gohalt.Throttler, with GRPCWith, on GRPCOn) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		h grpc.UnaryHandler,
+	) (resp interface{}, err error) {
+		r := gohalt.NewRunnerSync(with(ctx, req), thr)
+		r.Run(func(ctx context.Context) error {
+			resp, err = h(ctx, req)
+			return nil
+		})
+		if err := r.Result(); err != nil {
+			return nil, on(err)
+		}
+		return resp, err
+	}
+}
+
+func NewGRPCStreamServerInterceptor(thr gohalt.Throttler, with GRPCStreamWith, on GRPCStreamOn) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, h grpc.StreamHandler) error {
+		return h(srv, NewGrpServerStream(ss, thr, with, on))
+	}
+}
+
+func NewGRPCUnaryClientInterceptor(thr gohalt.Throttler, with GRPCWith, on GRPCOn) grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context,
+		method string,
+		req interface{},
+		resp interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) (err error) {
+		ctx = context.WithValue(ctx, grpcctxmethod{}, method)
+		r := gohalt.NewRunnerSync(with(ctx, req), thr)
+		r.Run(func(ctx context.Context) error {
+			err = invoker(ctx, method, req, resp, cc, opts...)
+			return nil
+		})
+		if err := r.Result(); err != nil {
+			return on(err)
+		}
+		return err
+	}
+}
+
+func NewGRPCStreamClientInterceptor(thr gohalt.Throttler, with GRPCStreamWith, on GRPCStreamOn) grpc.StreamClientInterceptor {
+	return func(
+		ctx context.Context,
+		desc *grpc.StreamDesc,
+		cc *grpc.ClientConn,
+		method string,
+		streamer grpc.Streamer,
+		opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		ctx = context.WithValue(ctx, grpcctxmethod{}, method)
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return NewGRPCClientStream(cs, thr, with, on), nil
+	}
+}
+
+type ConnectKey func(connect.Spec, connect.Peer, http.Header) string
+
+func ConnectKeyProcedure(spec connect.Spec, peer connect.Peer, header http.Header) string {
+	return spec.Procedure
+}
+
+func ConnectKeyPeer(spec connect.Spec, peer connect.Peer, header http.Header) string {
+	return normip(peer.Addr)
+}
+
+type ConnectWith func(context.Context, connect.Spec, connect.Peer, http.Header) context.Context
+
+func ConnectWithEmpty(ctx context.Context, spec connect.Spec, peer connect.Peer, header http.Header) context.Context {
+	return ctx
+}
+
+func ConnectWithKey(keys ...ConnectKey) ConnectWith {
+	return func(ctx context.Context, spec connect.Spec, peer connect.Peer, header http.Header) context.Context {
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			parts = append(parts, key(spec, peer, header))
+		}
+		return gohalt.WithKey(ctx, joinkey(parts...))
+	}
+}
+
+func ConnectWithProcedure(ctx context.Context, spec connect.Spec, peer connect.Peer, header http.Header) context.Context {
+	return ConnectWithKey(ConnectKeyProcedure)(ctx, spec, peer, header)
+}
+
+func ConnectWithPeer(ctx context.Context, spec connect.Spec, peer connect.Peer, header http.Header) context.Context {
+	return ConnectWithKey(ConnectKeyPeer)(ctx, spec, peer, header)
+}
+
+type ConnectOn func(error) error
+
+func ConnectOnAbort(err error) error {
+	return err
+}
+
+func ConnectOnResourceExhausted(err error) error {
+	q := newquota(err)
+	cerr := connect.NewError(connect.CodeResourceExhausted, err)
+	if q.reset > 0 {
+		if detail, derr := connect.NewErrorDetail(&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(q.reset),
+		}); derr == nil {
+			cerr.AddDetail(detail)
+		}
+	}
+	if detail, derr := connect.NewErrorDetail(&errdetails.QuotaFailure{
+		Violations: []*errdetails.QuotaFailure_Violation{
+			{Subject: q.throttler, Description: err.Error()},
+		},
+	}); derr == nil {
+		cerr.AddDetail(detail)
+	}
+	ratelimit(err, cerr.Meta().Set)
+	return cerr
+}
+
+type connectint struct {
+	thr  gohalt.Throttler
+	with ConnectWith
+	on   ConnectOn
+}
+
+func NewConnectInterceptor(thr gohalt.Throttler, with ConnectWith, on ConnectOn) connect.Interceptor {
+	return connectint{thr: thr, with: with, on: on}
+}
+
+func (i connectint) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (resp connect.AnyResponse, err error) {
+		r := gohalt.NewRunnerSync(i.with(ctx, req.Spec(), req.Peer(), req.Header()), i.thr)
+		r.Run(func(ctx context.Context) error {
+			resp, err = next(ctx, req)
+			return nil
+		})
+		if err := r.Result(); err != nil {
+			return nil, i.on(err)
+		}
+		return resp, err
+	}
+}
+
+func (i connectint) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return func(ctx context.Context, spec connect.Spec) connect.StreamingClientConn {
+		return connectcc{StreamingClientConn: next(ctx, spec), ctx: ctx, intr: i}
+	}
+}
+
+func (i connectint) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		return next(ctx, connecthc{StreamingHandlerConn: conn, ctx: ctx, intr: i})
+	}
+}
+
+func (i connectint) run(ctx context.Context, spec connect.Spec, peer connect.Peer, header http.Header, run func() error) (err error) {
+	r := gohalt.NewRunnerSync(i.with(ctx, spec, peer, header), i.thr)
+	r.Run(func(ctx context.Context) error {
+		err = run()
+		return nil
+	})
+	if err := r.Result(); err != nil {
+		return i.on(err)
+	}
+	return err
+}
+
+type connectcc struct {
+	connect.StreamingClientConn
+	ctx  context.Context
+	intr connectint
+}
+
+func (cc connectcc) Send(msg interface{}) error {
+	return cc.intr.run(cc.ctx, cc.Spec(), cc.Peer(), cc.RequestHeader(), func() error {
+		return cc.StreamingClientConn.Send(msg)
+	})
+}
+
+func (cc connectcc) Receive(msg interface{}) error {
+	return cc.intr.run(cc.ctx, cc.Spec(), cc.Peer(), cc.RequestHeader(), func() error {
+		return cc.StreamingClientConn.Receive(msg)
+	})
+}
+
+type connecthc struct {
+	connect.StreamingHandlerConn
+	ctx  context.Context
+	intr connectint
+}
+
+func (hc connecthc) Send(msg interface{}) error {
+	return hc.intr.run(hc.ctx, hc.Spec(), hc.Peer(), hc.RequestHeader(), func() error {
+		return hc.StreamingHandlerConn.Send(msg)
+	})
+}
+
+func (hc connecthc) Receive(msg interface{}) error {
+	return hc.intr.run(hc.ctx, hc.Spec(), hc.Peer(), hc.RequestHeader(), func() error {
+		return hc.StreamingHandlerConn.Receive(msg)
+	})
+}
+
+type twirpctxacquired struct{}
+
+type TwirpKey func(context.Context) string
+
+func TwirpKeyService(ctx context.Context) string {
+	service, _ := twirp.ServiceName(ctx)
+	if pkg, ok := twirp.PackageName(ctx); ok && pkg != "" {
+		return fmt.Sprintf("%s.%s", pkg, service)
+	}
+	return service
+}
+
+func TwirpKeyMethod(ctx context.Context) string {
+	method, _ := twirp.MethodName(ctx)
+	return fmt.Sprintf("%s/%s", TwirpKeyService(ctx), method)
+}
+
+type TwirpWith func(context.Context) context.Context
+
+func TwirpWithEmpty(ctx context.Context) context.Context {
+	return ctx
+}
+
+func TwirpWithKey(keys ...TwirpKey) TwirpWith {
+	return func(ctx context.Context) context.Context {
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			parts = append(parts, key(ctx))
+		}
+		return gohalt.WithKey(ctx, joinkey(parts...))
+	}
+}
+
+func TwirpWithService(ctx context.Context) context.Context {
+	return TwirpWithKey(TwirpKeyService)(ctx)
+}
+
+func TwirpWithMethod(ctx context.Context) context.Context {
+	return TwirpWithKey(TwirpKeyMethod)(ctx)
+}
+
+type TwirpOn func(context.Context, error) error
+
+func TwirpOnAbort(ctx context.Context, err error) error {
+	return err
+}
+
+func TwirpOnResourceExhausted(ctx context.Context, err error) error {
+	twerr := twirp.WrapError(twirp.NewError(twirp.ResourceExhausted, err.Error()), err)
+	twerr = twerr.WithMeta("throttler", newquota(err).throttler)
+	ratelimit(err, func(key string, val string) {
+		twerr = twerr.WithMeta(key, val)
+		_ = twirp.SetHTTPResponseHeader(ctx, key, val)
+	})
+	return twerr
+}
+
+func NewTwirpServerHooks(thr gohalt.Throttler, with TwirpWith, on TwirpOn) *twirp.ServerHooks {
+	return &twirp.ServerHooks{
+		RequestRouted: func(ctx context.Context) (context.Context, error) {
+			tctx := with(ctx)
+			if err := thr.Acquire(tctx); err != nil {
+				return ctx, on(ctx, err)
+			}
+			return context.WithValue(ctx, twirpctxacquired{}, tctx), nil
+		},
+		ResponseSent: func(ctx context.Context) {
+			if tctx, ok := ctx.Value(twirpctxacquired{}).(context.Context); ok {
+				_ = thr.Release(tctx)
+			}
+		},
+	}
+}
+
+type TwirpClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type twirpcli struct {
+	TwirpClient
+	thr  gohalt.Throttler
+	with TwirpWith
+	on   TwirpOn
+}
+
+func NewTwirpClient(cli TwirpClient, thr gohalt.Throttler, with TwirpWith, on TwirpOn) TwirpClient {
+	return twirpcli{TwirpClient: cli, thr: thr, with: with, on: on}
+}
+
+func (cli twirpcli) Do(req *http.Request) (resp *http.Response, err error) {
+	r := gohalt.NewRunnerSync(cli.with(req.Context()), cli.thr)
+	r.Run(func(ctx context.Context) error {
+		resp, err = cli.TwirpClient.Do(req)
+		return nil
+	})
+	if err := r.Result(); err != nil {
+		err = cli.on(req.Context(), err)
+		var twerr twirp.Error
+		if !errors.As(err, &twerr) {
+			return nil, err
+		}
+		body, err := json.Marshal(map[string]interface{}{
+			"code": twerr.Code(),
+			"msg":  twerr.Msg(),
+			"meta": twerr.MetaMap(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		status := twirp.ServerHTTPStatusFromErrorCode(twerr.Code())
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			StatusCode:    status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	return resp, err
+}
+
+type MicroRequest interface {
+	Service() string
+	Endpoint() string
+	ContentType() string
+}
+
+type MicroKey func(context.Context, MicroRequest) string
+
+func MicroKeyService(ctx context.Context, req MicroRequest) string {
+	return req.Service()
+}
+
+func MicroKeyEndpoint(ctx context.Context, req MicroRequest) string {
+	return fmt.Sprintf("%s/%s", req.Service(), req.Endpoint())
+}
+
+func MicroKeyContentType(ctx context.Context, req MicroRequest) string {
+	return req.ContentType()
+}
+
+func MicroKeyMetadata(key string) MicroKey {
+	return func(ctx context.Context, req MicroRequest) string {
+		val, _ := micrometa.Get(ctx, key)
+		return val
+	}
+}
+
+func MicroKeyCaller(ctx context.Context, req MicroRequest) string {
+	return MicroKeyMetadata("Micro-From-Service")(ctx, req)
+}
+
+type MicroClientWith func(context.Context, client.Request) context.Context
+
+func MicroClientWithEmpty(ctx context.Context, req client.Request) context.Context {
+	return ctx
+}
+
+func MicroClientWithKey(keys ...MicroKey) MicroClientWith {
+	return func(ctx context.Context, req client.Request) context.Context {
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			parts = append(parts, key(ctx, req))
+		}
+		return gohalt.WithKey(ctx, joinkey(parts...))
+	}
+}
+
+func MicroClientWithService(ctx context.Context, req client.Request) context.Context {
+	return MicroClientWithKey(MicroKeyService)(ctx, req)
+}
+
+func MicroClientWithEndpoint(ctx context.Context, req client.Request) context.Context {
+	return MicroClientWithKey(MicroKeyEndpoint)(ctx, req)
+}
+
+func MicroClientWithMetadata(key string) MicroClientWith {
+	return MicroClientWithKey(MicroKeyMetadata(key))
+}
+
+func MicroClientWithContentType(ctx context.Context, req client.Request) context.Context {
+	return MicroClientWithKey(MicroKeyContentType)(ctx, req)
+}
+
+type MicroServerWith func(context.Context, server.Request) context.Context
+
+func MicroServerEmpty(ctx context.Context, req server.Request) context.Context {
+	return ctx
+}
+
+func MicroServerWithKey(keys ...MicroKey) MicroServerWith {
+	return func(ctx context.Context, req server.Request) context.Context {
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			parts = append(parts, key(ctx, req))
+		}
+		return gohalt.WithKey(ctx, joinkey(parts...))
+	}
+}
+
+func MicroServerWithService(ctx context.Context, req server.Request) context.Context {
+	return MicroServerWithKey(MicroKeyService)(ctx, req)
+}
+
+func MicroServerWithEndpoint(ctx context.Context, req server.Request) context.Context {
+	return MicroServerWithKey(MicroKeyEndpoint)(ctx, req)
+}
+
+func MicroServerWithCaller(ctx context.Context, req server.Request) context.Context {
+	return MicroServerWithKey(MicroKeyCaller)(ctx, req)
+}
+
+func MicroServerWithMetadata(key string) MicroServerWith {
+	return MicroServerWithKey(MicroKeyMetadata(key))
+}
+
+func MicroServerWithContentType(ctx context.Context, req server.Request) context.Context {
+	return MicroServerWithKey(MicroKeyContentType)(ctx, req)
+}
+
+type MicroOn func(error) error
+
+func MicroOnAbort(err error) error {
+	return err
+}
+
+type microcli struct {
+	client.Client
+	thr  gohalt.Throttler
+	with MicroClientWith
+	on   MicroOn
+}
+
+func NewMicroClient(thr gohalt.Throttler, with MicroClientWith, on MicroOn) client.Wrapper {
+	return func(cli client.Client) client.Client {
+		return microcli{Client: cli, thr: thr, with: with, on: on}
+	}
 }
 
-func (cs grpccs) RecvMsg(msg interface{}) (err error) {
-	r := gohalt.NewRunnerSync(cs.with(cs.Context(), msg), cs.thr)
+func (cli microcli) Call(
+	ctx context.Context,
+	req client.Request,
+	resp interface{},
+	opts ...client.CallOption,
+) (err error) {
+	r := gohalt.NewRunnerSync(cli.with(ctx, req), cli.thr)
 	r.Run(func(ctx context.Context) error {
-		err = cs.ClientStream.RecvMsg(msg)
+		err = cli.Client.Call(ctx, req, resp, opts...)
 		return nil
 	})
 	if err := r.Result(); err != nil {
-		return cs.on(err)
+		return cli.on(err)
 	}
 	return err
 }
 
-type grpcss struct {
-	grpc.ServerStream
-	thr  gohalt.Throttler
-	with GRPCStreamWith
-	on   GRPCStreamOn
+func (cli microcli) Publish(ctx context.Context, msg client.Message, opts ...client.PublishOption) error {
+	pub := micropub{Client: cli.Client, thr: cli.thr, with: MicroPublishWithTopic, on: cli.on}
+	return pub.Publish(ctx, msg, opts...)
 }
 
-func NewGrpServerStream(ss grpc.ServerStream, thr gohalt.Throttler, with GRPCStreamWith, on GRPCStreamOn) grpc.ServerStream {
-	return grpcss{ServerStream: ss, thr: thr, with: with, on: on}
+func (cli microcli) Stream(ctx context.Context, req client.Request, opts ...client.CallOption) (client.Stream, error) {
+	st, err := cli.Client.Stream(ctx, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return microst{Stream: st, thr: cli.thr, with: cli.with, on: cli.on}, nil
 }
 
-func (ss grpcss) SendMsg(msg interface{}) (err error) {
-	r := gohalt.NewRunnerSync(ss.with(ss.Context(), msg), ss.thr)
+type microst struct {
+	client.Stream
+	thr  gohalt.Throttler
+	with MicroClientWith
+	on   MicroOn
+}
+
+func (st microst) Send(msg interface{}) (err error) {
+	r := gohalt.NewRunnerSync(st.with(st.Context(), st.Request()), st.thr)
 	r.Run(func(ctx context.Context) error {
-		err = ss.ServerStream.SendMsg(msg)
+		err = st.Stream.Send(msg)
 		return nil
 	})
 	if err := r.Result(); err != nil {
-		return ss.on(err)
+		return st.on(err)
 	}
 	return err
 }
 
-func (ss grpcss) RecvMsg(msg interface{}) (err error) {
-	r := gohalt.NewRunnerSync(ss.with(ss.Context(), msg), ss.thr)
+func (st microst) Recv(msg interface{}) (err error) {
+	r := gohalt.NewRunnerSync(st.with(st.Context(), st.Request()), st.thr)
 	r.Run(func(ctx context.Context) error {
-		err = ss.ServerStream.RecvMsg(msg)
+		err = st.Stream.Recv(msg)
 		return nil
 	})
 	if err := r.Result(); err != nil {
-		return ss.on(err)
+		return st.on(err)
 	}
 	return err
 }
 
-type MicroClientWith func(context.Context, client.Request) context.Context
-
-func MicroClientWithEmpty(ctx context.Context, req client.Request) context.Context {
-	return ctx
-}
-
-type MicroServerWith func(context.Context, server.Request) context.Context
+type MicroPublishWith func(context.Context, client.Message) context.Context
 
-func MicroServerEmpty(ctx context.Context, req server.Request) context.Context {
+func MicroPublishWithEmpty(ctx context.Context, msg client.Message) context.Context {
 	return ctx
 }
 
-type MicroOn func(error) error
-
-func MicroOnAbort(err error) error {
-	return err
+func MicroPublishWithTopic(ctx context.Context, msg client.Message) context.Context {
+	return gohalt.WithKey(ctx, msg.Topic())
 }
 
-type microcli struct {
+type micropub struct {
 	client.Client
 	thr  gohalt.Throttler
-	with MicroClientWith
+	with MicroPublishWith
 	on   MicroOn
 }
 
-func NewMicroClient(thr gohalt.Throttler, with MicroClientWith, on MicroOn) client.Wrapper {
+func NewMicroPublisher(thr gohalt.Throttler, with MicroPublishWith, on MicroOn) client.Wrapper {
 	return func(cli client.Client) client.Client {
-		return microcli{Client: cli, thr: thr, with: with, on: on}
+		return micropub{Client: cli, thr: thr, with: with, on: on}
 	}
 }
 
-func (cli microcli) Call(
-	ctx context.Context,
-	req client.Request,
-	resp interface{},
-	opts ...client.CallOption,
-) (err error) {
-	r := gohalt.NewRunnerSync(cli.with(ctx, req), cli.thr)
+func (cli micropub) Publish(ctx context.Context, msg client.Message, opts ...client.PublishOption) (err error) {
+	r := gohalt.NewRunnerSync(cli.with(ctx, msg), cli.thr)
 	r.Run(func(ctx context.Context) error {
-		err = cli.Client.Call(ctx, req, resp, opts...)
+		err = cli.Client.Publish(ctx, msg, opts...)
 		return nil
 	})
 	if err := r.Result(); err != nil {
@@ -609,78 +2346,402 @@ func NewMicroHandler(thr gohalt.Throttler, with MicroServerWith, on MicroOn) ser
 	}
 }
 
-type NetConnWith func() context.Context
+type MicroSubscriberWith func(context.Context, server.Message) context.Context
+
+func MicroSubscriberWithEmpty(ctx context.Context, msg server.Message) context.Context {
+	return ctx
+}
+
+func MicroSubscriberWithTopic(ctx context.Context, msg server.Message) context.Context {
+	return gohalt.WithKey(ctx, msg.Topic())
+}
+
+func NewMicroSubscriber(thr gohalt.Throttler, with MicroSubscriberWith, on MicroOn) server.SubscriberWrapper {
+	return func(h server.SubscriberFunc) server.SubscriberFunc {
+		return func(ctx context.Context, msg server.Message) (err error) {
+			r := gohalt.NewRunnerSync(with(ctx, msg), thr)
+			r.Run(func(ctx context.Context) error {
+				err = h(ctx, msg)
+				return nil
+			})
+			if err := r.Result(); err != nil {
+				return on(err)
+			}
+			return err
+		}
+	}
+}
+
+type IOKind int
+
+const (
+	IOKindRead IOKind = iota
+	IOKindWrite
+)
+
+const bwdefchunk = 32 * 1024
+
+func bwchunk(chunk int) int {
+	if chunk <= 0 {
+		return bwdefchunk
+	}
+	return chunk
+}
+
+type rwthr struct {
+	thr   gohalt.Throttler
+	with  func(IOKind, []byte) (context.Context, context.CancelFunc)
+	on    func(context.Context, error) error
+	chunk int
+}
+
+func (t rwthr) run(kind IOKind, p []byte, run func()) error {
+	ctx, cancel := t.with(kind, p)
+	defer cancel()
+	if t.chunk > 0 {
+		ctx = gohalt.WithWeight(ctx, int64(len(p)))
+	}
+	r := gohalt.NewRunnerSync(ctx, t.thr)
+	r.Run(func(context.Context) error {
+		run()
+		return nil
+	})
+	if err := r.Result(); err != nil {
+		return t.on(ctx, err)
+	}
+	return nil
+}
+
+func (t rwthr) read(r io.Reader, p []byte) (n int, err error) {
+	if t.chunk == 0 {
+		if err := t.run(IOKindRead, p, func() {
+			n, err = r.Read(p)
+		}); err != nil {
+			return 0, err
+		}
+		return n, err
+	}
+	if len(p) > t.chunk {
+		p = p[:t.chunk]
+	}
+	n, err = r.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	if err := t.run(IOKindRead, p[:n], func() {}); err != nil {
+		return n, err
+	}
+	return n, err
+}
+
+func (t rwthr) write(w io.Writer, p []byte) (n int, err error) {
+	if t.chunk == 0 {
+		if err := t.run(IOKindWrite, p, func() {
+			n, err = w.Write(p)
+		}); err != nil {
+			return 0, err
+		}
+		return n, err
+	}
+	for len(p) > 0 {
+		b := p
+		if len(b) > t.chunk {
+			b = b[:t.chunk]
+		}
+		var m int
+		if err := t.run(IOKindWrite, b, func() {
+			m, err = w.Write(b)
+		}); err != nil {
+			return n, err
+		}
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+type NetConnWith func(net.Conn, IOKind, []byte) context.Context
 
-func NetConnWithBackground() context.Context {
+func NetConnWithBackground(conn net.Conn, kind IOKind, p []byte) context.Context {
 	return context.Background()
 }
 
+func NetConnWithIP(conn net.Conn, kind IOKind, p []byte) context.Context {
+	return gohalt.WithKey(context.Background(), normip(conn.RemoteAddr().String()))
+}
+
 type NetConnOn func(error) error
 
 func NetConnAbort(err error) error {
 	return err
 }
 
+type NetConnMode int
+
+const (
+	NetConnModeRead NetConnMode = 1 << iota
+	NetConnModeWrite
+	NetConnModeDuplex = NetConnModeRead | NetConnModeWrite
+)
+
 type netconn struct {
 	net.Conn
-	thr  gohalt.Throttler
-	with NetConnWith
-	on   NetConnOn
-}
+	rthr  gohalt.Throttler
+	wthr  gohalt.Throttler
+	with  NetConnWith
+	on    NetConnOn
+	chunk int
 
-type connread = netconn
-type connwrite = netconn
+	lock      sync.Mutex
+	deadlines [2]time.Time
+	ops       [2]map[*netconnop]struct{}
+}
 
-type NetConnMode int
+type netconnop struct {
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	expired bool
+}
 
-const (
-	NetConnModeRead  NetConnMode = iota
-	NetConnModeWrite NetConnMode = iota
-)
+type netconnopkey struct{}
 
 func NewNetConn(conn net.Conn, thr gohalt.Throttler, with NetConnWith, on NetConnOn, mode NetConnMode) net.Conn {
-	switch mode {
-	case NetConnModeRead:
-		return connread{
-			Conn: conn,
-			thr:  thr,
-			with: with,
-			on:   on,
-		}
-	case NetConnModeWrite:
-		return connwrite{
-			Conn: conn,
-			thr:  thr,
-			with: with,
-			on:   on,
-		}
-	default:
+	return newnetconn(conn, thr, thr, with, on, mode, 0)
+}
+
+func NewNetConnBandwidth(
+	conn net.Conn,
+	thr gohalt.Throttler,
+	with NetConnWith,
+	on NetConnOn,
+	mode NetConnMode,
+	chunk int,
+) net.Conn {
+	return newnetconn(conn, thr, thr, with, on, mode, bwchunk(chunk))
+}
+
+func NewNetConnDuplex(
+	conn net.Conn,
+	rthr gohalt.Throttler,
+	wthr gohalt.Throttler,
+	with NetConnWith,
+	on NetConnOn,
+) net.Conn {
+	return newnetconn(conn, rthr, wthr, with, on, NetConnModeDuplex, 0)
+}
+
+func NewNetConnDuplexBandwidth(
+	conn net.Conn,
+	rthr gohalt.Throttler,
+	wthr gohalt.Throttler,
+	with NetConnWith,
+	on NetConnOn,
+	chunk int,
+) net.Conn {
+	return newnetconn(conn, rthr, wthr, with, on, NetConnModeDuplex, bwchunk(chunk))
+}
+
+func newnetconn(
+	conn net.Conn,
+	rthr gohalt.Throttler,
+	wthr gohalt.Throttler,
+	with NetConnWith,
+	on NetConnOn,
+	mode NetConnMode,
+	chunk int,
+) net.Conn {
+	nconn := &netconn{Conn: conn, with: with, on: on, chunk: chunk}
+	if mode&NetConnModeDuplex == 0 {
 		return nil
 	}
+	if mode&NetConnModeRead != 0 {
+		nconn.rthr = rthr
+	}
+	if mode&NetConnModeWrite != 0 {
+		nconn.wthr = wthr
+	}
+	return nconn
 }
 
-func (conn connread) Read(b []byte) (n int, err error) {
-	r := gohalt.NewRunnerSync(conn.with(), conn.thr)
-	r.Run(func(ctx context.Context) error {
-		n, err = conn.Conn.Read(b)
-		return nil
-	})
-	if err := r.Result(); err != nil {
-		return 0, conn.on(err)
+func (conn *netconn) Read(b []byte) (n int, err error) {
+	if conn.rthr == nil {
+		return conn.Conn.Read(b)
 	}
-	return n, err
+	return conn.rw(conn.rthr).read(conn.Conn, b)
 }
 
-func (conn connwrite) Write(b []byte) (n int, err error) {
-	r := gohalt.NewRunnerSync(conn.with(), conn.thr)
-	r.Run(func(ctx context.Context) error {
-		n, err = conn.Conn.Read(b)
-		return nil
+func (conn *netconn) Write(b []byte) (n int, err error) {
+	if conn.wthr == nil {
+		return conn.Conn.Write(b)
+	}
+	return conn.rw(conn.wthr).write(conn.Conn, b)
+}
+
+func (conn *netconn) SetDeadline(t time.Time) error {
+	conn.deadline(IOKindRead, t)
+	conn.deadline(IOKindWrite, t)
+	return conn.Conn.SetDeadline(t)
+}
+
+func (conn *netconn) SetReadDeadline(t time.Time) error {
+	conn.deadline(IOKindRead, t)
+	return conn.Conn.SetReadDeadline(t)
+}
+
+func (conn *netconn) SetWriteDeadline(t time.Time) error {
+	conn.deadline(IOKindWrite, t)
+	return conn.Conn.SetWriteDeadline(t)
+}
+
+func (conn *netconn) rw(thr gohalt.Throttler) rwthr {
+	return rwthr{thr: thr, with: conn.context, on: conn.abort, chunk: conn.chunk}
+}
+
+func (conn *netconn) context(kind IOKind, p []byte) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(conn.with(conn.Conn, kind, p))
+	op := &netconnop{cancel: cancel}
+	ctx = context.WithValue(ctx, netconnopkey{}, op)
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.ops[kind] == nil {
+		conn.ops[kind] = make(map[*netconnop]struct{})
+	}
+	conn.ops[kind][op] = struct{}{}
+	conn.timer(op, conn.deadlines[kind])
+	return ctx, func() {
+		conn.lock.Lock()
+		defer conn.lock.Unlock()
+		if op.timer != nil {
+			op.timer.Stop()
+			op.timer = nil
+		}
+		delete(conn.ops[kind], op)
+		cancel()
+	}
+}
+
+func (conn *netconn) abort(ctx context.Context, err error) error {
+	if op, ok := ctx.Value(netconnopkey{}).(*netconnop); ok {
+		conn.lock.Lock()
+		expired := op.expired
+		conn.lock.Unlock()
+		if expired {
+			return os.ErrDeadlineExceeded
+		}
+	}
+	return conn.on(err)
+}
+
+func (conn *netconn) deadline(kind IOKind, t time.Time) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.deadlines[kind] = t
+	for op := range conn.ops[kind] {
+		conn.timer(op, t)
+	}
+}
+
+func (conn *netconn) timer(op *netconnop, deadline time.Time) {
+	if op.timer != nil {
+		op.timer.Stop()
+		op.timer = nil
+	}
+	if deadline.IsZero() {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(deadline), func() {
+		conn.lock.Lock()
+		defer conn.lock.Unlock()
+		if op.timer != timer {
+			return
+		}
+		op.expired = true
+		op.cancel()
 	})
-	if err := r.Result(); err != nil {
-		return 0, conn.on(err)
+	op.timer = timer
+}
+
+type ListenerWith func(net.Conn) context.Context
+
+func ListenerWithIP(conn net.Conn) context.Context {
+	return gohalt.WithKey(context.Background(), normip(conn.RemoteAddr().String()))
+}
+
+type ListenerOn func(net.Conn, error) error
+
+func ListenerOnClose(conn net.Conn, err error) error {
+	_ = conn.Close()
+	return nil
+}
+
+func ListenerOnDelay(delay time.Duration) ListenerOn {
+	return func(conn net.Conn, err error) error {
+		_ = conn.Close()
+		time.Sleep(delay)
+		return nil
+	}
+}
+
+type listener struct {
+	net.Listener
+	thr  gohalt.Throttler
+	with ListenerWith
+	on   ListenerOn
+	wrap func(net.Conn) net.Conn
+}
+
+func NewListener(ln net.Listener, thr gohalt.Throttler, with ListenerWith, on ListenerOn) net.Listener {
+	return listener{Listener: ln, thr: thr, with: with, on: on}
+}
+
+func NewListenerWrap(
+	ln net.Listener,
+	thr gohalt.Throttler,
+	with ListenerWith,
+	on ListenerOn,
+	wrap func(net.Conn) net.Conn,
+) net.Listener {
+	return listener{Listener: ln, thr: thr, with: with, on: on, wrap: wrap}
+}
+
+func (ln listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ctx := ln.with(conn)
+		if err := ln.thr.Acquire(ctx); err != nil {
+			if err := ln.on(conn, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		conn = &lconn{Conn: conn, thr: ln.thr, ctx: ctx}
+		if ln.wrap != nil {
+			conn = ln.wrap(conn)
+		}
+		return conn, nil
 	}
-	return n, err
+}
+
+type lconn struct {
+	net.Conn
+	thr  gohalt.Throttler
+	ctx  context.Context
+	once sync.Once
+}
+
+func (conn *lconn) Close() error {
+	err := conn.Conn.Close()
+	conn.once.Do(func() {
+		_ = conn.thr.Release(conn.ctx)
+	})
+	return err
 }
 
 type SQLClient interface {
@@ -696,6 +2757,21 @@ func SQLClientQuery(ctx context.Context, query string, args ...interface{}) cont
 	return gohalt.WithKey(ctx, query)
 }
 
+func SQLClientWithCost(costs map[string]int64) SQLClientWith {
+	return func(ctx context.Context, query string, args ...interface{}) context.Context {
+		return gohalt.WithWeight(ctx, cost(costs, query))
+	}
+}
+
+func SQLClientWithChain(withs ...SQLClientWith) SQLClientWith {
+	return func(ctx context.Context, query string, args ...interface{}) context.Context {
+		for _, with := range withs {
+			ctx = with(ctx, query, args...)
+		}
+		return ctx
+	}
+}
+
 type SQLClientOn func(error) error
 
 func SQLClientAbort(err error) error {
@@ -761,9 +2837,9 @@ func (cli sqlcli) QueryRowContext(ctx context.Context, query string, args ...int
 	return row
 }
 
-type RWWith func() context.Context
+type RWWith func(IOKind, []byte) context.Context
 
-func RWWithBackground() context.Context {
+func RWWithBackground(kind IOKind, p []byte) context.Context {
 	return context.Background()
 }
 
@@ -773,58 +2849,126 @@ func RWAbort(err error) error {
 	return err
 }
 
+func newrwthr(thr gohalt.Throttler, with RWWith, on RWOn, chunk int) rwthr {
+	return rwthr{
+		thr: thr,
+		with: func(kind IOKind, p []byte) (context.Context, context.CancelFunc) {
+			return with(kind, p), func() {}
+		},
+		on: func(ctx context.Context, err error) error {
+			return on(err)
+		},
+		chunk: chunk,
+	}
+}
+
 type reader struct {
 	io.Reader
-	thr  gohalt.Throttler
-	with RWWith
-	on   RWOn
+	thr rwthr
 }
 
 func NewReader(r io.Reader, thr gohalt.Throttler, with RWWith, on RWOn) io.Reader {
 	return reader{
 		Reader: r,
-		thr:    thr,
-		with:   with,
-		on:     on,
+		thr:    newrwthr(thr, with, on, 0),
+	}
+}
+
+func NewReaderBandwidth(r io.Reader, thr gohalt.Throttler, with RWWith, on RWOn, chunk int) io.Reader {
+	return reader{
+		Reader: r,
+		thr:    newrwthr(thr, with, on, bwchunk(chunk)),
 	}
 }
 
 func (r reader) Read(p []byte) (n int, err error) {
-	rs := gohalt.NewRunnerSync(r.with(), r.thr)
-	rs.Run(func(context.Context) error {
-		n, err = r.Reader.Read(p)
-		return nil
-	})
-	if err := rs.Result(); err != nil {
-		return 0, r.on(err)
+	return r.thr.read(r.Reader, p)
+}
+
+func (r reader) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, struct{ io.Reader }{r})
+}
+
+type readcloser struct {
+	reader
+	io.Closer
+}
+
+func NewReadCloser(rc io.ReadCloser, thr gohalt.Throttler, with RWWith, on RWOn) io.ReadCloser {
+	return readcloser{
+		reader: reader{Reader: rc, thr: newrwthr(thr, with, on, 0)},
+		Closer: rc,
+	}
+}
+
+func NewReadCloserBandwidth(rc io.ReadCloser, thr gohalt.Throttler, with RWWith, on RWOn, chunk int) io.ReadCloser {
+	return readcloser{
+		reader: reader{Reader: rc, thr: newrwthr(thr, with, on, bwchunk(chunk))},
+		Closer: rc,
+	}
+}
+
+type readseeker struct {
+	reader
+	io.Seeker
+}
+
+func NewReadSeeker(rs io.ReadSeeker, thr gohalt.Throttler, with RWWith, on RWOn) io.ReadSeeker {
+	return readseeker{
+		reader: reader{Reader: rs, thr: newrwthr(thr, with, on, 0)},
+		Seeker: rs,
+	}
+}
+
+func NewReadSeekerBandwidth(rs io.ReadSeeker, thr gohalt.Throttler, with RWWith, on RWOn, chunk int) io.ReadSeeker {
+	return readseeker{
+		reader: reader{Reader: rs, thr: newrwthr(thr, with, on, bwchunk(chunk))},
+		Seeker: rs,
 	}
-	return n, err
 }
 
 type writer struct {
 	io.Writer
-	thr  gohalt.Throttler
-	with RWWith
-	on   RWOn
+	thr rwthr
 }
 
 func NewWriter(w io.Writer, thr gohalt.Throttler, with RWWith, on RWOn) io.Writer {
 	return writer{
 		Writer: w,
-		thr:    thr,
-		with:   with,
-		on:     on,
+		thr:    newrwthr(thr, with, on, 0),
+	}
+}
+
+func NewWriterBandwidth(w io.Writer, thr gohalt.Throttler, with RWWith, on RWOn, chunk int) io.Writer {
+	return writer{
+		Writer: w,
+		thr:    newrwthr(thr, with, on, bwchunk(chunk)),
 	}
 }
 
 func (w writer) Write(p []byte) (n int, err error) {
-	r := gohalt.NewRunnerSync(w.with(), w.thr)
-	r.Run(func(context.Context) error {
-		n, err = w.Writer.Write(p)
-		return nil
-	})
-	if err := r.Result(); err != nil {
-		return 0, w.on(err)
+	return w.thr.write(w.Writer, p)
+}
+
+func (w writer) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+type writecloser struct {
+	writer
+	io.Closer
+}
+
+func NewWriteCloser(wc io.WriteCloser, thr gohalt.Throttler, with RWWith, on RWOn) io.WriteCloser {
+	return writecloser{
+		writer: writer{Writer: wc, thr: newrwthr(thr, with, on, 0)},
+		Closer: wc,
+	}
+}
+
+func NewWriteCloserBandwidth(wc io.WriteCloser, thr gohalt.Throttler, with RWWith, on RWOn, chunk int) io.WriteCloser {
+	return writecloser{
+		writer: writer{Writer: wc, thr: newrwthr(thr, with, on, bwchunk(chunk))},
+		Closer: wc,
 	}
-	return n, err
 }
@@ -0,0 +1,385 @@
+package gohaltlib
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1pkg/gohalt"
+)
+
+func TestIPResolver(t *testing.T) {
+	table := map[string]struct {
+		cidrs     []string
+		hops      int
+		forwarded bool
+		remote    string
+		headers   map[string]string
+		ip        string
+	}{
+		"Default resolver should ignore spoofed forwarding headers": {
+			remote:  "203.0.113.9:5000",
+			headers: map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Real-Ip": "5.6.7.8"},
+			ip:      "203.0.113.9",
+		},
+		"Resolver should ignore spoofed forwarding headers from untrusted peer": {
+			cidrs:   []string{"10.0.0.0/8"},
+			remote:  "203.0.113.9:5000",
+			headers: map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			ip:      "203.0.113.9",
+		},
+		"Resolver should skip trusted proxies in forwarding chain": {
+			cidrs:   []string{"10.0.0.0/8"},
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.0.0.2"},
+			ip:      "1.2.3.4",
+		},
+		"Resolver should use real ip header when forwarded for is missing": {
+			cidrs:   []string{"10.0.0.1"},
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Real-Ip": "1.2.3.4"},
+			ip:      "1.2.3.4",
+		},
+		"Resolver should pick hop from the right of forwarding chain": {
+			hops:    2,
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.0.0.2"},
+			ip:      "1.2.3.4",
+		},
+		"Resolver should clamp hop count larger than forwarding chain": {
+			hops:    5,
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "1.2.3.4, 10.0.0.2"},
+			ip:      "1.2.3.4",
+		},
+		"Resolver should normalize ipv6 peer with brackets and port": {
+			remote: "[2001:db8::1]:443",
+			ip:     "2001:db8::1",
+		},
+		"Resolver should normalize ipv6 forwarded for with brackets and port": {
+			cidrs:     []string{"10.0.0.0/8"},
+			forwarded: true,
+			remote:    "10.0.0.1:5000",
+			headers:   map[string]string{"Forwarded": `for="[2001:db8::2]:4711";proto=https`},
+			ip:        "2001:db8::2",
+		},
+		"Resolver should prefer forwarded header over forwarded for": {
+			cidrs:     []string{"10.0.0.0/8"},
+			forwarded: true,
+			remote:    "10.0.0.1:5000",
+			headers:   map[string]string{"Forwarded": "for=1.2.3.4, for=10.0.0.2", "X-Forwarded-For": "5.6.7.8"},
+			ip:        "1.2.3.4",
+		},
+		"Resolver should fall back to peer on unknown forwarded for": {
+			cidrs:     []string{"10.0.0.0/8"},
+			forwarded: true,
+			remote:    "10.0.0.1:5000",
+			headers:   map[string]string{"Forwarded": "for=unknown"},
+			ip:        "10.0.0.1",
+		},
+		"Resolver should stop at the closest hop before unknown forwarded for": {
+			cidrs:     []string{"10.0.0.0/8"},
+			forwarded: true,
+			remote:    "10.0.0.1:5000",
+			headers:   map[string]string{"Forwarded": "for=1.2.3.4, for=unknown, for=10.0.0.2"},
+			ip:        "10.0.0.2",
+		},
+		"Resolver should fall back to peer on unknown hop": {
+			hops:      1,
+			forwarded: true,
+			remote:    "10.0.0.1:5000",
+			headers:   map[string]string{"Forwarded": "for=_hidden"},
+			ip:        "10.0.0.1",
+		},
+		"Resolver should skip empty forwarded for elements": {
+			cidrs:   []string{"10.0.0.0/8"},
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "1.2.3.4, , 10.0.0.2"},
+			ip:      "1.2.3.4",
+		},
+		"Resolver should skip empty forwarded for elements when counting hops": {
+			hops:    1,
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "1.2.3.4, ,"},
+			ip:      "1.2.3.4",
+		},
+		"Resolver should fall back to peer on empty forwarded for": {
+			cidrs:   []string{"10.0.0.0/8"},
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": " , "},
+			ip:      "10.0.0.1",
+		},
+	}
+	for tname, ptest := range table {
+		t.Run(tname, func(t *testing.T) {
+			res, err := NewIPResolver(ptest.cidrs, ptest.hops, ptest.forwarded)
+			if err != nil {
+				t.Fatalf("unexpected resolver error %v", err)
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = ptest.remote
+			for key, val := range ptest.headers {
+				req.Header.Set(key, val)
+			}
+			if ip := res.Resolve(req); ip != ptest.ip {
+				t.Errorf("expected resolved ip %q, got %q", ptest.ip, ip)
+			}
+		})
+	}
+}
+
+func TestNewIPResolverInvalid(t *testing.T) {
+	for _, cidr := range []string{"", "10.0.0", "10.0.0.0/33", "proxy"} {
+		if _, err := NewIPResolver([]string{cidr}, 0, false); err == nil {
+			t.Errorf("expected resolver error for %q", cidr)
+		}
+	}
+}
+
+func TestStdKeyNamespaces(t *testing.T) {
+	jwt := func(payload string) string {
+		return "Bearer e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	}
+	table := map[string]struct {
+		key    StdKey
+		header map[string]string
+		target string
+		res    string
+	}{
+		"JWT key should not collide with forged ip subject": {
+			key:    StdKeyFirst(StdKeyJWT("sub"), StdKeyIP),
+			header: map[string]string{"Authorization": jwt(`{"sub":"1.2.3.4"}`)},
+			res:    "jwt:1.2.3.4",
+		},
+		"JWT key should keep numeric subject exact": {
+			key:    StdKeyJWT("sub"),
+			header: map[string]string{"Authorization": jwt(`{"sub":12345678901234567890}`)},
+			res:    "jwt:12345678901234567890",
+		},
+		"JWT key should fall back to raw ip without token": {
+			key: StdKeyFirst(StdKeyJWT("sub"), StdKeyIP),
+			res: "1.2.3.4",
+		},
+		"API key should not collide with forged ip header": {
+			key:    StdKeyFirst(StdKeyAPIKey("X-Api-Key", "key"), StdKeyIP),
+			header: map[string]string{"X-Api-Key": "1.2.3.4"},
+			res:    "apikey:1.2.3.4",
+		},
+		"API key should not collide with forged ip query": {
+			key:    StdKeyFirst(StdKeyAPIKey("X-Api-Key", "key"), StdKeyIP),
+			target: "/?key=1.2.3.4",
+			res:    "apikey:1.2.3.4",
+		},
+		"Basic key should not collide with forged ip user": {
+			key:    StdKeyFirst(StdKeyBasic, StdKeyIP),
+			header: map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("1.2.3.4:pass"))},
+			res:    "basic:1.2.3.4",
+		},
+	}
+	for tname, ptest := range table {
+		t.Run(tname, func(t *testing.T) {
+			target := ptest.target
+			if target == "" {
+				target = "/"
+			}
+			req := httptest.NewRequest("GET", target, nil)
+			req.RemoteAddr = "1.2.3.4:5000"
+			for key, val := range ptest.header {
+				req.Header.Set(key, val)
+			}
+			if key := ptest.key(req); key != ptest.res {
+				t.Errorf("expected key %q, got %q", ptest.res, key)
+			}
+		})
+	}
+}
+
+type threshold string
+
+func (thr threshold) String() string {
+	return string(thr)
+}
+
+func TestQuota(t *testing.T) {
+	table := map[string]struct {
+		err error
+		q   quota
+	}{
+		"Quota should be empty for non threshold error": {
+			err: errors.New("test"),
+		},
+		"Quota should be empty for threshold error without threshold": {
+			err: gohalt.ErrorThreshold{Throttler: "test"},
+		},
+		"Quota should parse limit from count pair": {
+			err: gohalt.ErrorThreshold{Throttler: "test", Threshold: threshold("3 out of 5")},
+			q:   quota{throttler: "test", limit: 5, remaining: 2},
+		},
+		"Quota should parse limit from exceeded count pair": {
+			err: gohalt.ErrorThreshold{Throttler: "test", Threshold: threshold("7 out of 5")},
+			q:   quota{throttler: "test", limit: 5},
+		},
+		"Quota should parse limit from wrapped threshold error": {
+			err: fmt.Errorf("wrap: %w", gohalt.ErrorThreshold{Throttler: "test", Threshold: threshold("5 out of 5")}),
+			q:   quota{throttler: "test", limit: 5},
+		},
+		"Quota should parse reset from duration pair with remaining window": {
+			err: gohalt.ErrorThreshold{Throttler: "test", Threshold: threshold("1s out of 3s")},
+			q:   quota{throttler: "test", reset: 2 * time.Second},
+		},
+		"Quota should not parse reset from exceeded duration pair": {
+			err: gohalt.ErrorThreshold{Throttler: "test", Threshold: threshold("3s out of 2s")},
+			q:   quota{throttler: "test"},
+		},
+		"Quota should not parse reset from exhausted duration pair": {
+			err: gohalt.ErrorThreshold{Throttler: "test", Threshold: threshold("2s out of 2s")},
+			q:   quota{throttler: "test"},
+		},
+		"Quota should not parse malformed threshold": {
+			err: gohalt.ErrorThreshold{Throttler: "test", Threshold: threshold("true")},
+			q:   quota{throttler: "test"},
+		},
+		"Quota should not parse mixed pair": {
+			err: gohalt.ErrorThreshold{Throttler: "test", Threshold: threshold("1 out of 3s")},
+			q:   quota{throttler: "test"},
+		},
+	}
+	for tname, ptest := range table {
+		t.Run(tname, func(t *testing.T) {
+			if q := newquota(ptest.err); q != ptest.q {
+				t.Errorf("expected quota %+v, got %+v", ptest.q, q)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	table := map[string]struct {
+		err     error
+		headers map[string]string
+		reset   bool
+	}{
+		"Rate limit should not set headers for non threshold error": {
+			err:     errors.New("test"),
+			headers: map[string]string{},
+		},
+		"Rate limit should set limit headers from count pair": {
+			err: gohalt.ErrorThreshold{Throttler: "test", Threshold: threshold("7 out of 5")},
+			headers: map[string]string{
+				"RateLimit-Limit":       "5",
+				"X-RateLimit-Limit":     "5",
+				"RateLimit-Remaining":   "0",
+				"X-RateLimit-Remaining": "0",
+			},
+		},
+		"Rate limit should set reset headers from duration pair with remaining window": {
+			err: gohalt.ErrorThreshold{Throttler: "test", Threshold: threshold("1s out of 2500ms")},
+			headers: map[string]string{
+				"RateLimit-Reset": "2",
+				"Retry-After":     "2",
+			},
+			reset: true,
+		},
+		"Rate limit should not set retry after from exceeded duration pair": {
+			err:     gohalt.ErrorThreshold{Throttler: "test", Threshold: threshold("3s out of 2s")},
+			headers: map[string]string{},
+		},
+	}
+	for tname, ptest := range table {
+		t.Run(tname, func(t *testing.T) {
+			h := http.Header{}
+			ratelimit(ptest.err, h.Set)
+			if reset := h.Get("X-RateLimit-Reset"); (reset != "") != ptest.reset {
+				t.Errorf("expected reset header presence %v, got %q", ptest.reset, reset)
+			}
+			h.Del("X-RateLimit-Reset")
+			if len(h) != len(ptest.headers) {
+				t.Errorf("expected headers %v, got %v", ptest.headers, h)
+			}
+			for key, val := range ptest.headers {
+				if hval := h.Get(key); hval != val {
+					t.Errorf("expected header %s %q, got %q", key, val, hval)
+				}
+			}
+		})
+	}
+}
+
+type blockthr struct{}
+
+func (blockthr) Acquire(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (blockthr) Release(context.Context) error {
+	return nil
+}
+
+func TestNetConnDeadline(t *testing.T) {
+	table := map[string]struct {
+		with  NetConnWith
+		reads int
+		err   error
+	}{
+		"Net conn should abort throttled read on deadline": {
+			with:  NetConnWithBackground,
+			reads: 1,
+			err:   os.ErrDeadlineExceeded,
+		},
+		"Net conn should abort all concurrent throttled reads on deadline": {
+			with:  NetConnWithBackground,
+			reads: 3,
+			err:   os.ErrDeadlineExceeded,
+		},
+		"Net conn should not report cancelled context as deadline": {
+			with: func(net.Conn, IOKind, []byte) context.Context {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx
+			},
+			reads: 1,
+			err:   context.Canceled,
+		},
+	}
+	for tname, ptest := range table {
+		t.Run(tname, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c2.Close()
+			conn := NewNetConn(c1, blockthr{}, ptest.with, NetConnAbort, NetConnModeRead)
+			defer conn.Close()
+			errs := make(chan error, ptest.reads)
+			var wg sync.WaitGroup
+			wg.Add(ptest.reads)
+			for i := 0; i < ptest.reads; i++ {
+				go func() {
+					wg.Done()
+					_, err := conn.Read(make([]byte, 8))
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			if err := conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+				t.Fatalf("unexpected deadline error %v", err)
+			}
+			for i := 0; i < ptest.reads; i++ {
+				select {
+				case err := <-errs:
+					if !errors.Is(err, ptest.err) {
+						t.Errorf("expected read error %v, got %v", ptest.err, err)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("expected throttled read to be aborted")
+				}
+			}
+		})
+	}
+}